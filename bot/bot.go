@@ -0,0 +1,214 @@
+// Package bot is the event/command dispatcher that sits between the
+// gateway and user code: it turns raw dispatch payloads into typed
+// handler calls, and parses prefixed commands out of MESSAGE_CREATE.
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors" // go get github.com/pkg/errors
+
+	"github.com/DSarratt/disgordian/discord"
+	"github.com/DSarratt/disgordian/gateway"
+	"github.com/DSarratt/disgordian/logging"
+)
+
+// Context is handed to every handler and command. It carries the REST
+// client plus whatever metadata we could pull off the triggering event.
+type Context struct {
+	context.Context
+
+	REST      *discord.REST
+	ChannelID string
+	UserID    string
+	ShardID   int
+}
+
+// CommandFunc handles a single parsed command invocation.
+type CommandFunc func(ctx *Context, args []string)
+
+// Middleware wraps a command invocation; call next to continue the
+// chain, or return without calling it to short-circuit (e.g. a failed
+// permission check).
+type Middleware func(ctx *Context, name string, args []string, next func())
+
+// job is a unit of work handed to the worker pool: a handler call
+// already bound to its arguments.
+type job func()
+
+// Bot is the event dispatcher: handler slices per event type, plus a
+// command registry layered on top of MESSAGE_CREATE.
+type Bot struct {
+	REST   *discord.REST
+	Shards *gateway.ShardManager
+	Prefix string
+
+	onMessageCreate []func(*Context, *discord.Message)
+	onReady         []func(*Context, json.RawMessage)
+	onGuildCreate   []func(*Context, json.RawMessage)
+
+	commands   map[string]CommandFunc
+	middleware []Middleware
+
+	jobs chan job
+
+	mu        sync.Mutex
+	userID    string
+	voiceJoin map[string]*voiceJoin
+}
+
+// New builds a Bot that sends replies through rest and parses commands
+// prefixed with prefix (e.g. "!"). shards is used to pick which
+// gateway connection owns a given guild, e.g. for JoinVoice.
+func New(rest *discord.REST, shards *gateway.ShardManager, prefix string) *Bot {
+	return &Bot{
+		REST:      rest,
+		Shards:    shards,
+		Prefix:    prefix,
+		commands:  make(map[string]CommandFunc),
+		voiceJoin: make(map[string]*voiceJoin),
+	}
+}
+
+// OnMessageCreate registers a handler run for every MESSAGE_CREATE,
+// regardless of whether it's a recognized command.
+func (b *Bot) OnMessageCreate(fn func(*Context, *discord.Message)) {
+	b.onMessageCreate = append(b.onMessageCreate, fn)
+}
+
+// OnReady registers a handler run when the gateway session becomes ready.
+func (b *Bot) OnReady(fn func(*Context, json.RawMessage)) {
+	b.onReady = append(b.onReady, fn)
+}
+
+// OnGuildCreate registers a handler run for every GUILD_CREATE.
+func (b *Bot) OnGuildCreate(fn func(*Context, json.RawMessage)) {
+	b.onGuildCreate = append(b.onGuildCreate, fn)
+}
+
+// Command registers fn to run when a message starts with the bot's
+// prefix followed by name, e.g. Command("ping", ...) matches "!ping".
+func (b *Bot) Command(name string, fn CommandFunc) {
+	b.commands[name] = fn
+}
+
+// Use appends middleware to the command chain, innermost-last: the
+// first Use call wraps the outermost layer.
+func (b *Bot) Use(mw Middleware) {
+	b.middleware = append(b.middleware, mw)
+}
+
+// Run starts the worker pool that handlers are dispatched onto. It
+// must be called before Dispatch.
+func (b *Bot) Run(workers int) {
+	b.jobs = make(chan job, 64)
+	for i := 0; i < workers; i++ {
+		go b.worker()
+	}
+}
+
+func (b *Bot) worker() {
+	for j := range b.jobs {
+		b.safeRun(j)
+	}
+}
+
+// safeRun recovers from a panicking handler so one broken handler
+// can't take down the dispatcher.
+func (b *Bot) safeRun(j job) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Logger.Warn().Interface("panic", r).Msg("handler panicked")
+		}
+	}()
+	j()
+}
+
+// Dispatch routes one gateway dispatch payload, tagged with the shard
+// it arrived on, to the registered handlers (and, for MESSAGE_CREATE,
+// the command registry). Handlers run on the worker pool, so Dispatch
+// doesn't wait for them to finish; it does block while the pool's job
+// queue (64 entries) is full.
+func (b *Bot) Dispatch(ctx context.Context, shardID int, payload gateway.Payload) {
+	ctx = discord.WithShardID(ctx, shardID)
+
+	switch payload.T {
+	case "READY":
+		var ready struct {
+			User struct{ Id string }
+		}
+		json.Unmarshal(*payload.D, &ready)
+		b.mu.Lock()
+		b.userID = ready.User.Id
+		b.mu.Unlock()
+
+		for _, fn := range b.onReady {
+			fn := fn
+			b.enqueue(&Context{Context: ctx, REST: b.REST, ShardID: shardID}, func(c *Context) { fn(c, *payload.D) })
+		}
+
+	case "VOICE_STATE_UPDATE":
+		b.handleVoiceStateUpdate(*payload.D)
+
+	case "VOICE_SERVER_UPDATE":
+		b.handleVoiceServerUpdate(*payload.D)
+
+	case "GUILD_CREATE":
+		for _, fn := range b.onGuildCreate {
+			fn := fn
+			b.enqueue(&Context{Context: ctx, REST: b.REST, ShardID: shardID}, func(c *Context) { fn(c, *payload.D) })
+		}
+
+	case "MESSAGE_CREATE":
+		var msg discord.Message
+		if err := json.Unmarshal(*payload.D, &msg); err != nil {
+			logging.Logger.Warn().Stack().Err(errors.WithStack(err)).Msg("couldn't decode MESSAGE_CREATE")
+			return
+		}
+		c := &Context{Context: ctx, REST: b.REST, ChannelID: msg.Channel_id, UserID: msg.User_id, ShardID: shardID}
+
+		for _, fn := range b.onMessageCreate {
+			fn := fn
+			b.enqueue(c, func(c *Context) { fn(c, &msg) })
+		}
+
+		if name, args, ok := b.parseCommand(msg.Content); ok {
+			if cmd, ok := b.commands[name]; ok {
+				b.enqueue(c, func(c *Context) { b.runCommand(c, name, args, cmd) })
+			}
+		}
+	}
+}
+
+func (b *Bot) enqueue(c *Context, fn func(*Context)) {
+	b.jobs <- func() { fn(c) }
+}
+
+// parseCommand splits "<prefix><name> <args...>" into name and args.
+func (b *Bot) parseCommand(content string) (name string, args []string, ok bool) {
+	if b.Prefix == "" || !strings.HasPrefix(content, b.Prefix) {
+		return "", nil, false
+	}
+	fields := strings.Fields(strings.TrimPrefix(content, b.Prefix))
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+	return fields[0], fields[1:], true
+}
+
+// runCommand threads the invocation through the middleware chain,
+// outermost-first, before finally calling cmd.
+func (b *Bot) runCommand(ctx *Context, name string, args []string, cmd CommandFunc) {
+	next := func(ctx *Context, name string, args []string) { cmd(ctx, args) }
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		mw := b.middleware[i]
+		prev := next
+		next = func(ctx *Context, name string, args []string) {
+			mw(ctx, name, args, func() { prev(ctx, name, args) })
+		}
+	}
+	next(ctx, name, args)
+}
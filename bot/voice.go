@@ -0,0 +1,176 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/DSarratt/disgordian/gateway"
+	"github.com/DSarratt/disgordian/voice"
+)
+
+// voiceJoin tracks one in-flight JoinVoice call: it's waiting for the
+// main gateway to deliver both halves of the handshake, which can
+// arrive in either order.
+type voiceJoin struct {
+	sessionID chan string
+	server    chan voiceServerInfo
+}
+
+type voiceServerInfo struct {
+	Token    string
+	Endpoint string
+}
+
+// JoinVoice joins a voice channel: it sends an opcode 4 Update Voice
+// State on the guild's shard, waits for Discord to answer with a
+// session ID and a voice server to use, then opens the voice gateway
+// itself. Pass an empty channelID to disconnect: JoinVoice then returns
+// a nil Connection and nil error as soon as the update has been sent.
+func (b *Bot) JoinVoice(ctx context.Context, guildID, channelID string) (*voice.Connection, error) {
+	b.mu.Lock()
+	userID := b.userID
+	b.mu.Unlock()
+	if userID == "" {
+		return nil, fmt.Errorf("bot: can't join voice before the session is ready")
+	}
+	if b.Shards == nil {
+		return nil, fmt.Errorf("bot: no shard manager configured")
+	}
+
+	join := &voiceJoin{sessionID: make(chan string, 1), server: make(chan voiceServerInfo, 1)}
+	b.mu.Lock()
+	b.voiceJoin[guildID] = join
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.voiceJoin, guildID)
+		b.mu.Unlock()
+	}()
+
+	shard, err := b.shardForGuild(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.sendVoiceStateUpdate(ctx, shard, guildID, channelID); err != nil {
+		return nil, err
+	}
+	if channelID == "" {
+		// Leaving a channel yields no VOICE_SERVER_UPDATE, so there's
+		// nothing to wait for or connect to.
+		return nil, nil
+	}
+
+	sessionID, server, err := join.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return voice.Connect(ctx, voice.ConnectInfo{
+		GuildID:   guildID,
+		UserID:    userID,
+		SessionID: sessionID,
+		Token:     server.Token,
+		Endpoint:  server.Endpoint,
+	})
+}
+
+// wait blocks until both halves of the handshake have arrived.
+func (j *voiceJoin) wait(ctx context.Context) (string, voiceServerInfo, error) {
+	var sessionID string
+	var server voiceServerInfo
+	for sessionID == "" || server.Token == "" {
+		select {
+		case sessionID = <-j.sessionID:
+		case server = <-j.server:
+		case <-ctx.Done():
+			return "", voiceServerInfo{}, ctx.Err()
+		}
+	}
+	return sessionID, server, nil
+}
+
+func (b *Bot) shardForGuild(guildID string) (*gateway.Shard, error) {
+	gid, err := strconv.ParseUint(guildID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bot: invalid guild id %q: %v", guildID, err)
+	}
+	shardID := b.Shards.ShardForGuild(gid)
+	if shardID < 0 || shardID >= len(b.Shards.Shards) {
+		return nil, fmt.Errorf("bot: no shard for guild %v", guildID)
+	}
+	return b.Shards.Shards[shardID], nil
+}
+
+func (b *Bot) sendVoiceStateUpdate(ctx context.Context, shard *gateway.Shard, guildID, channelID string) error {
+	var channel *string
+	if channelID != "" {
+		channel = &channelID
+	}
+	d, err := json.Marshal(struct {
+		Guild_id   string  `json:"guild_id"`
+		Channel_id *string `json:"channel_id"`
+		Self_mute  bool    `json:"self_mute"`
+		Self_deaf  bool    `json:"self_deaf"`
+	}{guildID, channel, false, false})
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf(`{"op": %d, "d": %s}`, gateway.OpVoiceStateUpdate, d)
+
+	select {
+	case shard.Session.SendQueue <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleVoiceStateUpdate feeds our own VOICE_STATE_UPDATE (identified
+// by user ID) to any JoinVoice call waiting on this guild.
+func (b *Bot) handleVoiceStateUpdate(raw json.RawMessage) {
+	var vs struct {
+		Guild_id   string
+		Session_id string
+		User_id    string
+	}
+	json.Unmarshal(raw, &vs)
+
+	b.mu.Lock()
+	isUs := vs.User_id == b.userID
+	join := b.voiceJoin[vs.Guild_id]
+	b.mu.Unlock()
+	if join == nil || !isUs {
+		return
+	}
+
+	select {
+	case join.sessionID <- vs.Session_id:
+	default:
+	}
+}
+
+// handleVoiceServerUpdate feeds a VOICE_SERVER_UPDATE to any JoinVoice
+// call waiting on this guild.
+func (b *Bot) handleVoiceServerUpdate(raw json.RawMessage) {
+	var vs struct {
+		Guild_id string
+		Token    string
+		Endpoint string
+	}
+	json.Unmarshal(raw, &vs)
+
+	b.mu.Lock()
+	join := b.voiceJoin[vs.Guild_id]
+	b.mu.Unlock()
+	if join == nil {
+		return
+	}
+
+	select {
+	case join.server <- voiceServerInfo{Token: vs.Token, Endpoint: vs.Endpoint}:
+	default:
+	}
+}
@@ -0,0 +1,211 @@
+// Package discord is the REST client: it knows how to talk to
+// Discord's HTTP API while respecting its per-route and global rate
+// limits, so callers never have to think about 429s themselves.
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DSarratt/disgordian/logging"
+)
+
+// Base URL for the REST api
+const BASE_URL = "https://discordapp.com/api"
+
+// shardIDKey is the context key WithShardID/ShardID use. REST itself is
+// shared across every shard, so it has no shard of its own; callers that
+// know which shard triggered a request (e.g. bot.Dispatch) attach it to
+// ctx so Do can fold it into its log lines.
+type shardIDKey struct{}
+
+// WithShardID returns a copy of ctx tagged with the shard that triggered
+// the request it's passed to, so REST.Do's logs can attribute it.
+func WithShardID(ctx context.Context, shardID int) context.Context {
+	return context.WithValue(ctx, shardIDKey{}, shardID)
+}
+
+// ShardID returns the shard ID attached by WithShardID, if any.
+func ShardID(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(shardIDKey{}).(int)
+	return id, ok
+}
+
+// REST is a shared, rate-limit-aware Discord API client. Construct one
+// per bot token with NewREST and reuse it for every request.
+type REST struct {
+	Token string
+
+	client *http.Client
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+
+	globalMu      sync.Mutex
+	globalResetAt time.Time
+}
+
+// NewREST builds a REST client authenticated as the given bot token.
+func NewREST(token string) *REST {
+	return &REST{
+		Token:   token,
+		client:  &http.Client{},
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// bucketFor returns the bucket tracking the given route, creating it
+// if this is the first time we've seen it.
+func (r *REST) bucketFor(key string) *bucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{}
+		r.buckets[key] = b
+	}
+	return b
+}
+
+// waitForGlobal blocks while Discord has told us to pause every route,
+// e.g. after a global 429.
+func (r *REST) waitForGlobal(ctx context.Context) error {
+	r.globalMu.Lock()
+	resetAt := r.globalResetAt
+	r.globalMu.Unlock()
+
+	wait := time.Until(resetAt)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Do sends an authenticated request, blocking as needed to honor both
+// the route's bucket and any active global rate limit, and transparently
+// retrying after each 429 (for as long as ctx allows) until a non-429
+// response comes back. path may be a Discord-documented path (e.g.
+// /channels/{channel.id}) without the base API URL in front.
+func (r *REST) Do(ctx context.Context, method, path string, payload []byte) (*http.Response, error) {
+	key := routeKey(method, path)
+	b := r.bucketFor(key)
+	logCtx := logging.Logger.With().Str("route", key).Str("bucket", b.ID())
+	if shardID, ok := ShardID(ctx); ok {
+		logCtx = logCtx.Int("shard_id", shardID)
+	}
+	log := logCtx.Logger()
+
+	for {
+		if err := r.waitForGlobal(ctx); err != nil {
+			return nil, err
+		}
+		if err := b.Acquire(ctx); err != nil {
+			return nil, err
+		}
+
+		log.Debug().Msg("sending request")
+		resp, err := r.send(ctx, method, path, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		r.updateBucket(b, resp.Header)
+
+		if resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+
+		retryAfter, global, err := r.handleRateLimited(resp)
+		if err != nil {
+			return nil, err
+		}
+		if global {
+			r.globalMu.Lock()
+			r.globalResetAt = time.Now().Add(retryAfter)
+			r.globalMu.Unlock()
+		}
+		log.Warn().Bool("global", global).Dur("retry_after", retryAfter).Msg("rate limited, retrying")
+		timer := time.NewTimer(retryAfter)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *REST) send(ctx context.Context, method, path string, payload []byte) (*http.Response, error) {
+	url := path
+	if !strings.HasPrefix(url, BASE_URL) {
+		if strings.HasPrefix(url, "/") {
+			url = fmt.Sprintf("%v%v", BASE_URL, url)
+		} else {
+			url = fmt.Sprintf("%v/%v", BASE_URL, url)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bot %v", r.Token))
+	req.Header.Add("Content-Type", "application/json")
+
+	return r.client.Do(req)
+}
+
+func (r *REST) updateBucket(b *bucket, h http.Header) {
+	id := h.Get("X-RateLimit-Bucket")
+	limit := atoiOrZero(h.Get("X-RateLimit-Limit"))
+	remaining := atoiOrZero(h.Get("X-RateLimit-Remaining"))
+	resetAfter := parseSeconds(h.Get("X-RateLimit-Reset-After"))
+	if id == "" && limit == 0 && h.Get("X-RateLimit-Remaining") == "" {
+		// No rate limit headers on this response at all; leave the
+		// bucket's existing state alone.
+		return
+	}
+	b.update(id, limit, remaining, resetAfter)
+}
+
+// handleRateLimited reads a 429 body and tells the caller how long to
+// wait and whether the pause applies to every route.
+func (r *REST) handleRateLimited(resp *http.Response) (time.Duration, bool, error) {
+	defer resp.Body.Close()
+
+	global := resp.Header.Get("X-RateLimit-Global") == "true"
+
+	var body struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		// Fall back to the header if the body didn't parse.
+		return parseSeconds(resp.Header.Get("Retry-After")), global, nil
+	}
+	return time.Duration(body.RetryAfter * float64(time.Second)), global, nil
+}
+
+func parseSeconds(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(f * float64(time.Second))
+}
@@ -0,0 +1,47 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Message is Discord's "Message" object, as returned from the message
+// endpoints.
+type Message struct {
+	Id         string
+	Channel_id string
+	Content    string
+	Timestamp  string
+	User_id    string
+}
+
+// CreateMessageData is the request body for CreateMessage.
+type CreateMessageData struct {
+	Content string `json:"content"`
+}
+
+// CreateMessage posts a message to a channel.
+func (r *REST) CreateMessage(ctx context.Context, channelID string, data CreateMessageData) (*Message, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.Do(ctx, "POST", fmt.Sprintf("/channels/%v/messages", channelID), payload)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("discord: create message failed with status %d", resp.StatusCode)
+	}
+
+	var msg Message
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
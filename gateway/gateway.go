@@ -0,0 +1,450 @@
+// Package gateway owns the full Discord gateway session lifecycle:
+// connecting, heartbeating, resuming after a drop, and re-identifying
+// when Discord invalidates the session outright.
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors" // go get github.com/pkg/errors
+	"github.com/rs/zerolog"
+	"golang.org/x/net/websocket" // Go get golang.org/x/net/websocket
+
+	"github.com/DSarratt/disgordian/logging"
+)
+
+// Base URL for the REST api
+const BASE_URL = "https://discordapp.com/api"
+
+// What version of the gateway protocol do we speak?
+const GATEWAY_VERSION = "?v=5&encoding=json"
+
+// Template for generating heartbeats
+const HEARTBEAT_MSG = `{"op": 1, "d": %d}`
+
+// Close code reported in the log when a zombied connection is killed
+// before reconnecting. The socket itself is closed with the websocket
+// library's normal closure, not with this code (see closeZombie).
+const zombieCloseCode = 4000
+
+// Reconnect backoff bounds. Capped around 2 minutes per the request.
+const (
+	backoffMin = 1 * time.Second
+	backoffMax = 2 * time.Minute
+)
+
+// Session owns one gateway connection and everything needed to keep it
+// (or its replacement) alive: sequence number, session ID, resume URL.
+type Session struct {
+	Token string
+
+	// ShardID and NumShards are sent in every Identify so Discord can
+	// route the right slice of events to us. NumShards == 0 means an
+	// unsharded session, which omits the "shard" field entirely.
+	ShardID   int
+	NumShards int
+
+	// Outgoing websocket messages should be sent here
+	SendQueue chan string
+
+	// Incoming dispatch payloads are routed through here
+	RecvQueue chan Payload
+
+	// beforeIdentify, if set, is called (and must return) before every
+	// Identify is sent. The ShardManager uses this to gate IDENTIFY
+	// calls through its max_concurrency semaphore.
+	beforeIdentify func(context.Context) error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	ws *websocket.Conn
+
+	sessionID string
+	resumeURL string
+	seq       int
+
+	hbLength int
+	// hbAcked is cleared every time we send a heartbeat, and set again
+	// when opcode 11 comes back. If it's still clear when the next tick
+	// fires, the socket is a zombie.
+	hbAcked bool
+}
+
+// log returns a logger with this session's shard/session/sequence
+// fields attached, so operators can grep a single shard's activity. It
+// returns a pointer since zerolog's level methods (Debug, Info, ...)
+// take a pointer receiver, and a call site chaining straight off a
+// by-value return wouldn't be addressable.
+func (s *Session) log() *zerolog.Logger {
+	l := logging.Logger.With().Int("seq", s.seq)
+	if s.NumShards > 0 {
+		l = l.Int("shard_id", s.ShardID)
+	}
+	if s.sessionID != "" {
+		l = l.Str("session_id", s.sessionID)
+	}
+	logger := l.Logger()
+	return &logger
+}
+
+// New dials the gateway, performs the hello/identify handshake, and
+// returns a Session ready for Run. ctx governs the whole session: when
+// it's cancelled (e.g. by a signal handler) Run returns.
+func New(ctx context.Context, token string) (*Session, error) {
+	url, err := fetchGatewayURL()
+	if err != nil {
+		return nil, err
+	}
+	return newSession(ctx, token, url, 0, 0, nil)
+}
+
+// newSession is the shared constructor behind New and the ShardManager:
+// it dials the given gateway url (already resolved by the caller) and
+// identifies as the given shard.
+func newSession(ctx context.Context, token, url string, shardID, numShards int, beforeIdentify func(context.Context) error) (*Session, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Session{
+		Token:          token,
+		ShardID:        shardID,
+		NumShards:      numShards,
+		SendQueue:      make(chan string),
+		RecvQueue:      make(chan Payload),
+		beforeIdentify: beforeIdentify,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	if err := s.dial(url); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if err := s.identify(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// fetchGatewayURL asks Discord where to connect. It's a plain GET with
+// no auth, so it doesn't need the REST client's rate limiting.
+func fetchGatewayURL() (string, error) {
+	resp, err := http.Get(BASE_URL + "/gateway")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", errors.Errorf("received non-200 status code %d from gateway URL fetch", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var outputMap map[string]string
+	if err := json.Unmarshal(body, &outputMap); err != nil {
+		return "", errors.Wrap(err, "couldn't decode HTTP response")
+	}
+	url, ok := outputMap["url"]
+	if !ok {
+		return "", errors.New("didn't receive a url from the gateway URL fetch")
+	}
+	return url, nil
+}
+
+// dial opens the websocket and reads the Hello payload to learn the
+// heartbeat interval. It closes any previous connection first.
+func (s *Session) dial(url string) error {
+	if s.ws != nil {
+		s.ws.Close()
+	}
+
+	ws, err := websocket.Dial(url+GATEWAY_VERSION, "", "https://discordapp.com")
+	if err != nil {
+		return errors.Wrap(err, "failed to open websocket")
+	}
+	s.ws = ws
+	s.log().Debug().Msg("websocket opened")
+
+	var payload Payload
+	if err := websocket.JSON.Receive(ws, &payload); err != nil {
+		return errors.Wrap(err, "failed to read hello payload")
+	}
+	if payload.Op == nil || *payload.Op != OpHello {
+		return errors.Errorf("expected hello payload, got %v", payload)
+	}
+
+	var hello struct{ Heartbeat_interval int }
+	if err := json.Unmarshal(*payload.D, &hello); err != nil {
+		return err
+	}
+	s.hbLength = hello.Heartbeat_interval
+	if s.hbLength == 0 {
+		return errors.Errorf("couldn't get heartbeat interval from %v", payload)
+	}
+	s.log().Debug().Int("heartbeat_ms", s.hbLength).Msg("received hello")
+	return nil
+}
+
+// identify sends a fresh opcode 2 Identify, abandoning any prior session.
+func (s *Session) identify() error {
+	if s.beforeIdentify != nil {
+		if err := s.beforeIdentify(s.ctx); err != nil {
+			return err
+		}
+	}
+
+	s.sessionID = ""
+	s.seq = 0
+
+	shardField := ""
+	if s.NumShards > 0 {
+		shardField = fmt.Sprintf(`,"shard": [%d, %d]`, s.ShardID, s.NumShards)
+	}
+
+	msg := fmt.Sprintf(`{
+		"op": 2,
+		"d": {
+			"token": "%v",
+			"properties": {
+				"$os": "linux",
+				"$browser": "Disgordian",
+				"$device": "Disgordian",
+				"$referrer": "",
+				"$referring_domain": ""
+			},
+			"compress": false,
+			"large_threshold": 250%v
+		}}`, s.Token, shardField)
+	return websocket.Message.Send(s.ws, msg)
+}
+
+// resume sends an opcode 6 Resume against the session we already have.
+func (s *Session) resume() error {
+	if s.resumeURL != "" {
+		if err := s.dial(s.resumeURL); err != nil {
+			return err
+		}
+	}
+	msg := fmt.Sprintf(`{
+		"op": 6,
+		"d": {
+			"token": "%v",
+			"session_id": "%v",
+			"seq": %d
+		}}`, s.Token, s.sessionID, s.seq)
+	return websocket.Message.Send(s.ws, msg)
+}
+
+// readyPayload is the subset of READY's data we care about.
+type readyPayload struct {
+	Session_id         string
+	Resume_gateway_url string
+}
+
+// invalidSession is opcode 9's data: whether we may resume.
+type invalidSession bool
+
+// Run drives the session until ctx is cancelled: it reads, heartbeats,
+// and sends, and transparently reconnects (resuming where possible)
+// whenever the socket drops, the server asks us to, or a heartbeat
+// goes unacknowledged.
+func (s *Session) Run() error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			s.ws.Close()
+		case <-done:
+		}
+	}()
+
+	boff := backoffMin
+	for {
+		err := s.runOnce()
+		if s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		if err == nil {
+			// Clean disconnect with nothing to report; still try to
+			// resume, same as any other drop.
+			s.log().Info().Msg("gateway connection closed, resuming")
+		} else {
+			s.log().Warn().Stack().Err(err).Msg("gateway connection lost, reconnecting")
+		}
+
+		if recErr := s.reconnect(); recErr != nil {
+			s.log().Warn().Stack().Err(recErr).Dur("backoff", boff).Msg("reconnect attempt failed")
+			select {
+			case <-time.After(jitter(boff)):
+			case <-s.ctx.Done():
+				return s.ctx.Err()
+			}
+			boff = nextBackoff(boff)
+			continue
+		}
+		boff = backoffMin
+	}
+}
+
+// Close cancels the session's context, unblocking Run and tearing down
+// the underlying websocket.
+func (s *Session) Close() {
+	s.cancel()
+}
+
+// reconnect tries to resume the existing session; if we have no
+// session to resume it falls back to a fresh connect + identify.
+func (s *Session) reconnect() error {
+	if s.sessionID == "" {
+		url, err := fetchGatewayURL()
+		if err != nil {
+			return err
+		}
+		if err := s.dial(url); err != nil {
+			return err
+		}
+		return s.identify()
+	}
+	if s.ws == nil {
+		url, err := fetchGatewayURL()
+		if err != nil {
+			return err
+		}
+		if err := s.dial(url); err != nil {
+			return err
+		}
+	}
+	return s.resume()
+}
+
+// runOnce reads and sends over the current websocket until it drops,
+// opcode 7/9 ask us to reconnect, or we detect a zombied heartbeat.
+func (s *Session) runOnce() error {
+	recv := make(chan Payload)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(recv)
+		for {
+			var payload Payload
+			if err := websocket.JSON.Receive(s.ws, &payload); err != nil {
+				recvErr <- err
+				return
+			}
+			recv <- payload
+		}
+	}()
+
+	s.hbAcked = true
+	pacemaker := time.NewTicker(time.Duration(s.hbLength) * time.Millisecond)
+	defer pacemaker.Stop()
+
+	for {
+		select {
+		case payload, open := <-recv:
+			if !open {
+				return <-recvErr
+			}
+			if payload.S != 0 {
+				s.seq = payload.S
+			}
+
+			switch {
+			case payload.Op == nil:
+				continue
+			case *payload.Op == OpDispatch:
+				if payload.T == "READY" {
+					var ready readyPayload
+					json.Unmarshal(*payload.D, &ready)
+					s.sessionID = ready.Session_id
+					s.resumeURL = ready.Resume_gateway_url
+					s.log().Info().Msg("session ready")
+				}
+				s.RecvQueue <- payload
+			case *payload.Op == OpHeartbeat:
+				// Discord is asking for an out-of-cycle heartbeat.
+				s.sendHeartbeat()
+			case *payload.Op == OpHeartbeatACK:
+				s.hbAcked = true
+			case *payload.Op == OpReconnect:
+				return errors.New("gateway requested reconnect")
+			case *payload.Op == OpInvalidSession:
+				var resumable invalidSession
+				json.Unmarshal(*payload.D, &resumable)
+				delay := time.Duration(rand.Intn(5)+1) * time.Second
+				s.log().Warn().Bool("resumable", bool(resumable)).Dur("delay", delay).Msg("invalid session")
+				time.Sleep(delay)
+				if !resumable {
+					s.sessionID = ""
+				}
+				return errors.New("invalid session")
+			}
+
+		case msg, open := <-s.SendQueue:
+			if !open {
+				return nil
+			}
+			if err := websocket.Message.Send(s.ws, msg); err != nil {
+				return err
+			}
+
+		case <-pacemaker.C:
+			if !s.hbAcked {
+				// No ACK since the last beat: the socket is a zombie.
+				s.closeZombie()
+				return errors.New("heartbeat not acknowledged, zombie connection")
+			}
+			s.sendHeartbeat()
+
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// sendHeartbeat sends an opcode 1 and clears hbAcked until the next
+// opcode 11 comes back.
+func (s *Session) sendHeartbeat() {
+	s.hbAcked = false
+	msg := fmt.Sprintf(HEARTBEAT_MSG, s.seq)
+	if err := websocket.Message.Send(s.ws, msg); err != nil {
+		s.log().Warn().Stack().Err(err).Msg("failed to send heartbeat")
+	}
+}
+
+// closeZombie tears down a connection that stopped acknowledging
+// heartbeats. x/net/websocket exposes no way to choose a close code, so
+// the connection is closed with the library's normal closure frame and
+// zombieCloseCode appears only in the log line, not on the wire.
+func (s *Session) closeZombie() {
+	s.log().Warn().Int("close_code", zombieCloseCode).Msg("closing zombie connection")
+	if s.ws != nil {
+		s.ws.Close()
+	}
+}
+
+// jitter returns d plus up to 20% extra, so many shards reconnecting
+// at once don't all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// nextBackoff doubles d, capped at backoffMax.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > backoffMax {
+		return backoffMax
+	}
+	return d
+}
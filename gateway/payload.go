@@ -0,0 +1,38 @@
+package gateway
+
+import "encoding/json"
+
+// Discord gateway opcodes we care about.
+// See https://discord.com/developers/docs/topics/opcodes-and-status-codes#gateway-opcodes
+const (
+	OpDispatch            = 0
+	OpHeartbeat           = 1
+	OpIdentify            = 2
+	OpStatusUpdate        = 3
+	OpVoiceStateUpdate    = 4
+	OpResume              = 6
+	OpReconnect           = 7
+	OpRequestGuildMembers = 8
+	OpInvalidSession      = 9
+	OpHello               = 10
+	OpHeartbeatACK        = 11
+)
+
+// Payload is the envelope every gateway message arrives and is sent in.
+type Payload struct {
+	// Op is a pointer because we need to know the difference between 0 and nil
+	Op *int
+	S  int
+	T  string
+	D  *json.RawMessage
+}
+
+// Somewhat circuitous way to print a Payload (by converting it back to JSON...)
+func (p Payload) String() string {
+	val, err := json.Marshal(p)
+	if err != nil {
+		// Marshalling failed???
+		return "{}"
+	}
+	return string(val)
+}
@@ -0,0 +1,191 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors" // go get github.com/pkg/errors
+
+	"github.com/DSarratt/disgordian/logging"
+)
+
+// gatewayBotResponse is the body of GET /gateway/bot.
+type gatewayBotResponse struct {
+	Url    string
+	Shards int
+
+	Session_start_limit struct {
+		Total                int
+		Remaining            int
+		Reset_after          int
+		Max_concurrent_login int
+	}
+}
+
+// ShardEvent is a dispatch payload tagged with the shard it arrived on.
+type ShardEvent struct {
+	ShardID int
+	Payload Payload
+}
+
+// Shard is one gateway connection belonging to a ShardManager.
+type Shard struct {
+	ID      int
+	Session *Session
+}
+
+// ShardManager owns every shard a bot needs and fans their dispatch
+// events into a single Events channel.
+type ShardManager struct {
+	Token string
+
+	NumShards      int
+	MaxConcurrency int
+
+	// Events carries every shard's dispatch payloads, tagged with
+	// which shard they came from.
+	Events chan ShardEvent
+
+	Shards []*Shard
+
+	gate *identifyGate
+}
+
+// NewShardManager calls GET /gateway/bot to learn how many shards to
+// run and how fast they may log in, then dials every shard. It refuses
+// to start if the remaining session-start budget can't cover NumShards.
+func NewShardManager(ctx context.Context, token string) (*ShardManager, error) {
+	info, err := fetchGatewayBot(token)
+	if err != nil {
+		return nil, err
+	}
+	if info.Session_start_limit.Remaining < info.Shards {
+		return nil, errors.Errorf(
+			"gateway: only %d session starts remaining, need %d to start all shards",
+			info.Session_start_limit.Remaining, info.Shards,
+		)
+	}
+
+	maxConcurrency := info.Session_start_limit.Max_concurrent_login
+	if maxConcurrency <= 0 {
+		maxConcurrency = 1
+	}
+
+	m := &ShardManager{
+		Token:          token,
+		NumShards:      info.Shards,
+		MaxConcurrency: maxConcurrency,
+		Events:         make(chan ShardEvent),
+		Shards:         make([]*Shard, info.Shards),
+		gate:           newIdentifyGate(maxConcurrency),
+	}
+
+	for i := 0; i < info.Shards; i++ {
+		bucket := i % maxConcurrency
+		beforeIdentify := func(ctx context.Context) error { return m.gate.Acquire(ctx, bucket) }
+
+		session, err := newSession(ctx, token, info.Url, i, info.Shards, beforeIdentify)
+		if err != nil {
+			return nil, errors.Wrapf(err, "gateway: failed to start shard %d", i)
+		}
+		shard := &Shard{ID: i, Session: session}
+		m.Shards[i] = shard
+
+		go m.pump(shard)
+		go func(id int) {
+			if err := session.Run(); err != nil && ctx.Err() == nil {
+				// Run never gives up reconnecting on its own; it only
+				// returns while ctx is live if the shard's Session.Close
+				// was called.
+				logging.Logger.Warn().Int("shard_id", id).Stack().Err(err).Msg("shard exited")
+			}
+		}(i)
+	}
+
+	return m, nil
+}
+
+// pump forwards one shard's RecvQueue into the manager's Events channel.
+func (m *ShardManager) pump(shard *Shard) {
+	for payload := range shard.Session.RecvQueue {
+		m.Events <- ShardEvent{ShardID: shard.ID, Payload: payload}
+	}
+}
+
+// ShardForGuild returns which shard owns a given guild, using Discord's
+// standard (guild_id >> 22) % num_shards formula. Outgoing REST calls
+// for that guild should be attributed to this shard in logs/metrics.
+func (m *ShardManager) ShardForGuild(guildID uint64) int {
+	return int((guildID >> 22) % uint64(m.NumShards))
+}
+
+// fetchGatewayBot asks Discord for the recommended shard count and the
+// bot's session-start budget. Unlike /gateway, this endpoint requires
+// authentication.
+func fetchGatewayBot(token string) (*gatewayBotResponse, error) {
+	req, err := http.NewRequest("GET", BASE_URL+"/gateway/bot", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bot %v", token))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.Errorf("received non-200 status code %d from /gateway/bot", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var info gatewayBotResponse
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, errors.Wrap(err, "couldn't decode /gateway/bot response")
+	}
+	return &info, nil
+}
+
+// identifyGate enforces Discord's max_concurrency rule: within a given
+// bucket (shard_id % max_concurrency), only one IDENTIFY may be sent
+// every 5 seconds. Different buckets may identify concurrently.
+type identifyGate struct {
+	mu   sync.Mutex
+	next []time.Time
+}
+
+func newIdentifyGate(buckets int) *identifyGate {
+	return &identifyGate{next: make([]time.Time, buckets)}
+}
+
+// Acquire blocks until bucket's next identify slot is free.
+func (g *identifyGate) Acquire(ctx context.Context, bucket int) error {
+	g.mu.Lock()
+	wait := time.Until(g.next[bucket])
+	if wait < 0 {
+		wait = 0
+	}
+	g.next[bucket] = time.Now().Add(wait + 5*time.Second)
+	g.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
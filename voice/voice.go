@@ -0,0 +1,344 @@
+// Package voice implements Discord's voice gateway and UDP audio
+// transport, so a bot can join a voice channel and stream Opus audio.
+//
+// Joining is a three-way handshake across two gateways: the main
+// gateway session tells Discord we want to join (opcode 4), Discord
+// replies on that same gateway with our voice session ID and the voice
+// server to use, and only then do we open a second, voice-specific
+// websocket to actually set up the call. Connect expects the caller
+// (the bot package) to have already done that first leg and handed us
+// the session ID, token and endpoint it yielded.
+package voice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/net/websocket"
+)
+
+// Voice gateway opcodes.
+// See https://discord.com/developers/docs/topics/voice-connections#voice-gateway-opcode-table
+const (
+	opIdentify           = 0
+	opSelectProtocol     = 1
+	opReady              = 2
+	opHeartbeat          = 3
+	opSessionDescription = 4
+	opSpeaking           = 5
+	opHeartbeatACK       = 6
+	opHello              = 8
+	opResumed            = 9
+)
+
+// Samples are sent in 20ms frames at 48kHz.
+const frameSamples = 960
+
+// ConnectInfo is everything Connect needs, gathered from the main
+// gateway's VOICE_STATE_UPDATE and VOICE_SERVER_UPDATE events.
+type ConnectInfo struct {
+	GuildID   string
+	UserID    string
+	SessionID string
+	Token     string
+	Endpoint  string
+}
+
+// Connection is a live voice call: a control websocket plus the UDP
+// socket audio actually flows over.
+type Connection struct {
+	info ConnectInfo
+
+	ws  *websocket.Conn
+	udp *net.UDPConn
+
+	ssrc      uint32
+	secretKey [32]byte
+
+	seq       uint16
+	timestamp uint32
+
+	done chan struct{}
+}
+
+type payload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+}
+
+// withDeadline runs a blocking operation on its own goroutine and
+// returns as soon as it finishes or ctx is cancelled, whichever comes
+// first. x/net/websocket and net.UDPConn have no context support of
+// their own, so on cancellation this is the only way to return
+// promptly: if closer is non-nil (the socket in question has already
+// been established) it's closed to unblock the in-flight read; fn's
+// goroutine is otherwise left to finish on its own, same as the
+// gateway package's shutdown-via-Close pattern.
+func withDeadline(ctx context.Context, closer func() error, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if closer != nil {
+			closer()
+		}
+		return ctx.Err()
+	}
+}
+
+// Connect performs the voice websocket handshake (Identify, Ready,
+// Select Protocol via UDP IP discovery, Session Description) and
+// starts the connection's heartbeat loop. The returned Connection is
+// ready for Send. ctx bounds the dial and every read of the handshake:
+// if it's cancelled mid-dial or mid-read, Connect returns ctx.Err()
+// instead of hanging on a stalled voice server.
+func Connect(ctx context.Context, info ConnectInfo) (*Connection, error) {
+	c := &Connection{info: info, done: make(chan struct{})}
+
+	endpoint := strings.TrimSuffix(info.Endpoint, ":80")
+	err := withDeadline(ctx, nil, func() error {
+		ws, err := websocket.Dial(fmt.Sprintf("wss://%v/?v=4", endpoint), "", "https://discordapp.com")
+		if err != nil {
+			return err
+		}
+		c.ws = ws
+		return nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("voice: failed to dial voice gateway: %v", err)
+	}
+
+	hbLength, err := c.readHello(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.identify(); err != nil {
+		return nil, err
+	}
+
+	ip, port, err := c.readReady(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	externalIP, externalPort, err := c.discoverIP(ctx, ip, port)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.selectProtocol(externalIP, externalPort); err != nil {
+		return nil, err
+	}
+
+	if err := c.readSessionDescription(ctx); err != nil {
+		return nil, err
+	}
+
+	go c.heartbeatLoop(time.Duration(hbLength) * time.Millisecond)
+
+	return c, nil
+}
+
+func (c *Connection) readHello(ctx context.Context) (int, error) {
+	var p payload
+	if err := withDeadline(ctx, c.ws.Close, func() error {
+		return websocket.JSON.Receive(c.ws, &p)
+	}); err != nil {
+		return 0, err
+	}
+	if p.Op != opHello {
+		return 0, fmt.Errorf("voice: expected hello, got opcode %d", p.Op)
+	}
+	var hello struct {
+		Heartbeat_interval int
+	}
+	if err := json.Unmarshal(p.D, &hello); err != nil {
+		return 0, err
+	}
+	return hello.Heartbeat_interval, nil
+}
+
+func (c *Connection) identify() error {
+	d, _ := json.Marshal(struct {
+		Server_id  string `json:"server_id"`
+		User_id    string `json:"user_id"`
+		Session_id string `json:"session_id"`
+		Token      string `json:"token"`
+	}{c.info.GuildID, c.info.UserID, c.info.SessionID, c.info.Token})
+	return c.send(opIdentify, d)
+}
+
+func (c *Connection) readReady(ctx context.Context) (ip string, port int, err error) {
+	var p payload
+	if err := withDeadline(ctx, c.ws.Close, func() error {
+		return websocket.JSON.Receive(c.ws, &p)
+	}); err != nil {
+		return "", 0, err
+	}
+	if p.Op != opReady {
+		return "", 0, fmt.Errorf("voice: expected ready, got opcode %d", p.Op)
+	}
+	var ready struct {
+		Ssrc  uint32
+		Ip    string
+		Port  int
+		Modes []string
+	}
+	if err := json.Unmarshal(p.D, &ready); err != nil {
+		return "", 0, err
+	}
+	c.ssrc = ready.Ssrc
+	return ready.Ip, ready.Port, nil
+}
+
+// discoverIP performs Discord's UDP IP discovery: send a packet
+// containing our SSRC to the voice server, and it echoes back the
+// address and port it sees us from (i.e. our NAT-mapped address).
+func (c *Connection) discoverIP(ctx context.Context, ip string, port int) (string, int, error) {
+	udp, err := net.Dial("udp", fmt.Sprintf("%v:%d", ip, port))
+	if err != nil {
+		return "", 0, fmt.Errorf("voice: failed to open UDP socket: %v", err)
+	}
+	c.udp = udp.(*net.UDPConn)
+
+	packet := make([]byte, 74)
+	binary.BigEndian.PutUint16(packet[0:2], 1) // request
+	binary.BigEndian.PutUint16(packet[2:4], 70)
+	binary.BigEndian.PutUint32(packet[4:8], c.ssrc)
+
+	if _, err := c.udp.Write(packet); err != nil {
+		return "", 0, fmt.Errorf("voice: IP discovery send failed: %v", err)
+	}
+
+	resp := make([]byte, 74)
+	if err := withDeadline(ctx, c.udp.Close, func() error {
+		_, err := c.udp.Read(resp)
+		return err
+	}); err != nil {
+		if ctx.Err() != nil {
+			return "", 0, ctx.Err()
+		}
+		return "", 0, fmt.Errorf("voice: IP discovery read failed: %v", err)
+	}
+
+	addr := strings.TrimRight(string(resp[8:72]), "\x00")
+	externalPort := binary.BigEndian.Uint16(resp[72:74])
+	return addr, int(externalPort), nil
+}
+
+func (c *Connection) selectProtocol(ip string, port int) error {
+	d, _ := json.Marshal(struct {
+		Protocol string `json:"protocol"`
+		Data     struct {
+			Address string `json:"address"`
+			Port    int    `json:"port"`
+			Mode    string `json:"mode"`
+		} `json:"data"`
+	}{
+		Protocol: "udp",
+		Data: struct {
+			Address string `json:"address"`
+			Port    int    `json:"port"`
+			Mode    string `json:"mode"`
+		}{ip, port, "xsalsa20_poly1305"},
+	})
+	return c.send(opSelectProtocol, d)
+}
+
+func (c *Connection) readSessionDescription(ctx context.Context) error {
+	var p payload
+	if err := withDeadline(ctx, c.ws.Close, func() error {
+		return websocket.JSON.Receive(c.ws, &p)
+	}); err != nil {
+		return err
+	}
+	if p.Op != opSessionDescription {
+		return fmt.Errorf("voice: expected session description, got opcode %d", p.Op)
+	}
+	var desc struct {
+		Secret_key []byte
+	}
+	if err := json.Unmarshal(p.D, &desc); err != nil {
+		return err
+	}
+	if len(desc.Secret_key) != 32 {
+		return fmt.Errorf("voice: secret key was %d bytes, expected 32", len(desc.Secret_key))
+	}
+	copy(c.secretKey[:], desc.Secret_key)
+	return nil
+}
+
+func (c *Connection) heartbeatLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			nonce := make([]byte, 8)
+			rand.Read(nonce)
+			d, _ := json.Marshal(binary.LittleEndian.Uint64(nonce))
+			if err := c.send(opHeartbeat, d); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Connection) send(op int, d json.RawMessage) error {
+	return websocket.JSON.Send(c.ws, payload{Op: op, D: d})
+}
+
+// Send packetizes a 20ms Opus frame into an RTP packet, encrypts it
+// with xsalsa20-poly1305 using the negotiated secret key, and writes
+// it to the UDP socket.
+func (c *Connection) Send(opusFrame []byte) error {
+	header := make([]byte, 12)
+	header[0] = 0x80
+	header[1] = 0x78
+	binary.BigEndian.PutUint16(header[2:4], c.seq)
+	binary.BigEndian.PutUint32(header[4:8], c.timestamp)
+	binary.BigEndian.PutUint32(header[8:12], c.ssrc)
+
+	// Discord's xsalsa20_poly1305 mode nonces with the 12-byte RTP
+	// header, zero-padded out to the 24 bytes secretbox requires.
+	var nonce [24]byte
+	copy(nonce[:], header)
+
+	packet := secretbox.Seal(header, opusFrame, &nonce, &c.secretKey)
+
+	if _, err := c.udp.Write(packet); err != nil {
+		return fmt.Errorf("voice: failed to write RTP packet: %v", err)
+	}
+
+	c.seq++
+	c.timestamp += frameSamples
+	return nil
+}
+
+// Close tears down the voice websocket and UDP socket.
+func (c *Connection) Close() error {
+	close(c.done)
+	if c.udp != nil {
+		c.udp.Close()
+	}
+	if c.ws != nil {
+		return c.ws.Close()
+	}
+	return nil
+}